@@ -1,10 +1,14 @@
 package clientservice
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/centrifugal/centrifugo/lib/client"
@@ -12,43 +16,352 @@ import (
 	"github.com/centrifugal/centrifugo/lib/node"
 	"github.com/centrifugal/centrifugo/lib/proto"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
 // Config for GRPC client Service.
-type Config struct{}
+type Config struct {
+	// StreamInterceptors is a chain of gRPC stream server interceptors run
+	// before Communicate sees the stream, in the order given. Use it to
+	// validate JWTs, check mTLS-derived identity or rate limit connections
+	// without forking the server. By convention an interceptor validates
+	// the `authentication`, `user-id` and any custom metadata pairs the
+	// client sent on the stream and rejects the call if they don't check
+	// out; Communicate then reads the `authentication` and `user-id` pairs
+	// via metadata.FromIncomingContext and turns them into
+	// client.Credentials for the connection. Other metadata pairs are not
+	// copied into the credentials.
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// ReplayBufferSize is how many recent channel push replies are
+	// retained per channel, per client-id, for replay to a reconnecting
+	// client. Direct command replies are never retained. Zero (the default)
+	// disables replay.
+	ReplayBufferSize int
+
+	// ReplayTTL bounds how long a retained reply stays eligible for
+	// replay. Zero means retention is bounded by ReplayBufferSize alone.
+	ReplayTTL time.Duration
+
+	// SendPolicy controls what happens when a client falls behind the
+	// rate of outgoing replies and the outbound buffer fills up, instead
+	// of always disconnecting it with Reconnect: true the instant that
+	// happens. Zero value is SendPolicyBlock.
+	SendPolicy SendPolicy
+}
+
+// SendPolicy is applied by grpcTransport.Send when the outbound reply queue
+// is full.
+type SendPolicy int
+
+const (
+	// SendPolicyBlock waits for room in the queue, bounded by the
+	// stream's context deadline/cancellation, instead of failing
+	// immediately.
+	SendPolicyBlock SendPolicy = iota
+	// SendPolicyDropOldest evicts the head of the queue to make room for
+	// the new reply. Useful for presence/join-leave style updates where
+	// only the latest state matters.
+	SendPolicyDropOldest
+	// SendPolicyDropNewest discards the incoming reply and leaves the
+	// queue as-is.
+	SendPolicyDropNewest
+	// SendPolicyCoalesce merges consecutive publications on the same
+	// channel, keeping only the latest one queued for delivery.
+	SendPolicyCoalesce
+)
 
 // Service can work with client GRPC connections.
 type Service struct {
 	config Config
 	node   *node.Node
+	replay *replayStore
 }
 
 // New creates new Service.
 func New(n *node.Node, c Config) *Service {
-	return &Service{
+	s := &Service{
 		config: c,
 		node:   n,
 	}
+	if c.ReplayBufferSize > 0 {
+		s.replay = newReplayStore(c.ReplayBufferSize, c.ReplayTTL)
+	}
+	return s
 }
 
 const replyBufferSize = 64
 
+// StreamInterceptor returns a single grpc.StreamServerInterceptor chaining
+// together all interceptors configured on Config, in order, suitable for
+// passing to grpc.NewServer(grpc.StreamInterceptor(...)).
+func (s *Service) StreamInterceptor() grpc.StreamServerInterceptor {
+	return chainStreamInterceptors(s.config.StreamInterceptors)
+}
+
+func chainStreamInterceptors(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor := interceptors[i]
+			next := chained
+			chained = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return chained(srv, ss)
+	}
+}
+
+// credentialsFromIncomingContext builds client.Credentials from the
+// `authentication` and `user-id` metadata pairs of an incoming gRPC stream,
+// if present. It returns nil when neither header is set, leaving identity
+// resolution to whatever the client sends in its Connect command.
+func credentialsFromIncomingContext(ctx context.Context) *client.Credentials {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	auth := firstMetadataValue(md, "authentication")
+	userID := firstMetadataValue(md, "user-id")
+	if auth == "" && userID == "" {
+		return nil
+	}
+	return &client.Credentials{
+		UserID: userID,
+		Token:  auth,
+	}
+}
+
+func firstMetadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// replayCursorFromIncomingContext reads the `client-id` and `last-seq`
+// metadata pairs a reconnecting client sets to ask for replay of whatever
+// it missed. clientID is empty when the client didn't ask for replay.
+func replayCursorFromIncomingContext(ctx context.Context) (clientID string, lastSeq uint64) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", 0
+	}
+	clientID = firstMetadataValue(md, "client-id")
+	if seqStr := firstMetadataValue(md, "last-seq"); seqStr != "" {
+		if parsed, err := strconv.ParseUint(seqStr, 10, 64); err == nil {
+			lastSeq = parsed
+		}
+	}
+	return clientID, lastSeq
+}
+
+// replayKeyFor reports the channel and seq a Reply should be filed under
+// for replay, if it's a channel push rather than a direct command reply
+// (which has no channel to catch up on and so is never retained).
+//
+// This reads Channel/Seq directly off the Reply instead of parsing Result:
+// Result is opaque payload bytes whose format depends on the transport's
+// Encoding (JSON or protobuf), so sniffing it for a JSON envelope broke
+// silently for every protobuf-encoded connection - every push replayKeyFor
+// saw came back !ok, so the replay buffer and SendPolicyCoalesce were both
+// silent no-ops against real gRPC traffic. Channel/Seq are carried
+// out-of-band on the Reply itself instead, so this works the same
+// regardless of Encoding.
+func replayKeyFor(reply *proto.Reply) (channel string, seq uint64, ok bool) {
+	if reply == nil || reply.ID != 0 || reply.Channel == "" {
+		return "", 0, false
+	}
+	return reply.Channel, reply.Seq, true
+}
+
+// replayEntry is one retained reply kept for replay to a reconnecting
+// client.
+type replayEntry struct {
+	seq      uint64
+	reply    *proto.Reply
+	storedAt time.Time
+}
+
+// replayStore retains the last ReplayBufferSize channel push replies sent
+// to each (client-id, channel) pair, bounded by ReplayTTL, so a client that
+// reconnects with the same client-id can replay whatever it missed before
+// resuming live delivery - without needing a full history replay from
+// Redis.
+type replayStore struct {
+	size int
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	byClient map[string]map[string][]replayEntry // client-id -> channel -> entries, oldest first
+}
+
+func newReplayStore(size int, ttl time.Duration) *replayStore {
+	return &replayStore{
+		size:     size,
+		ttl:      ttl,
+		byClient: make(map[string]map[string][]replayEntry),
+	}
+}
+
+// store appends reply to the buffer for clientID, keyed by the channel and
+// seq extracted from it. Replies with no channel/seq (direct command
+// replies rather than channel pushes) are ignored.
+func (r *replayStore) store(clientID string, reply *proto.Reply) {
+	if clientID == "" {
+		return
+	}
+	channel, seq, ok := replayKeyFor(reply)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channels, ok := r.byClient[clientID]
+	if !ok {
+		channels = make(map[string][]replayEntry)
+		r.byClient[clientID] = channels
+	}
+
+	entries := append(channels[channel], replayEntry{seq: seq, reply: reply, storedAt: time.Now()})
+	if len(entries) > r.size {
+		entries = entries[len(entries)-r.size:]
+	}
+	channels[channel] = entries
+}
+
+// replay invokes send, oldest first, for every retained reply across all
+// channels for clientID with seq greater than lastSeq, then forgets the
+// client's buffer - the reconnected stream repopulates it as new pushes
+// arrive. Entries older than ttl are skipped as stale.
+func (r *replayStore) replay(clientID string, lastSeq uint64, send func(*proto.Reply) error) error {
+	r.mu.Lock()
+	channels := r.byClient[clientID]
+	delete(r.byClient, clientID)
+	r.mu.Unlock()
+
+	var cutoff time.Time
+	if r.ttl > 0 {
+		cutoff = time.Now().Add(-r.ttl)
+	}
+
+	var missed []replayEntry
+	for _, entries := range channels {
+		for _, entry := range entries {
+			if entry.seq <= lastSeq {
+				continue
+			}
+			if !cutoff.IsZero() && entry.storedAt.Before(cutoff) {
+				continue
+			}
+			missed = append(missed, entry)
+		}
+	}
+	sort.SliceStable(missed, func(i, j int) bool {
+		return missed[i].storedAt.Before(missed[j].storedAt)
+	})
+	for _, entry := range missed {
+		if err := send(entry.reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientIDHolder lets a transport's recordPolicyAction closure report the
+// client.Client's ID once client.New has returned it, without the caller
+// mutating the transport itself after construction: the holder is created
+// and passed into the transport's constructor up front, same as every other
+// per-connection field, and only the ID inside it is filled in later, via
+// atomic.Value so a Send racing that fill is well-defined.
+type clientIDHolder struct {
+	v atomic.Value
+}
+
+func (h *clientIDHolder) set(id string) { h.v.Store(id) }
+
+func (h *clientIDHolder) get() string {
+	id, _ := h.v.Load().(string)
+	return id
+}
+
+// trailerSetter is the part of a GRPC server stream needed to report a
+// Disconnect back to the client as a trailer.
+type trailerSetter interface {
+	SetTrailer(metadata.MD)
+}
+
+func setDisconnectTrailer(stream trailerSetter, disconnect *proto.Disconnect) error {
+	disconnectJSON, err := json.Marshal(disconnect)
+	if err != nil {
+		return err
+	}
+	stream.SetTrailer(metadata.Pairs("disconnect", string(disconnectJSON)))
+	return nil
+}
+
 // Communicate is a bidirectional stream reading Command and
 // sending Reply to client.
 func (s *Service) Communicate(stream proto.Centrifugo_CommunicateServer) error {
 
-	replies := make(chan *proto.Reply, replyBufferSize)
-	transport := newGRPCTransport(stream, replies)
+	ctx := stream.Context()
+	if creds := credentialsFromIncomingContext(ctx); creds != nil {
+		ctx = client.SetCredentials(ctx, creds)
+	}
+
+	replayClientID, replayLastSeq := replayCursorFromIncomingContext(ctx)
+	recordReplay := func(*proto.Reply) {}
+	if s.replay != nil && replayClientID != "" {
+		recordReplay = func(reply *proto.Reply) { s.replay.store(replayClientID, reply) }
+	}
+
+	clientID := &clientIDHolder{}
+	recordPolicyAction := func(action string) {
+		s.node.Logger().Log(logging.NewEntry(logging.DEBUG, "GRPC send policy action", map[string]interface{}{"client": clientID.get(), "action": action}))
+	}
+
+	awaitingReplay := s.replay != nil && replayClientID != ""
+	transport := newGRPCTransport(stream, recordReplay, recordPolicyAction, s.config.SendPolicy, awaitingReplay)
 
-	c := client.New(stream.Context(), s.node, transport, client.Config{})
+	c := client.New(ctx, s.node, transport, client.Config{})
 	defer c.Close(proto.DisconnectNormal)
+	clientID.set(c.ID())
 
 	s.node.Logger().Log(logging.NewEntry(logging.DEBUG, "GRPC connection established", map[string]interface{}{"client": c.ID()}))
 	defer func(started time.Time) {
 		s.node.Logger().Log(logging.NewEntry(logging.DEBUG, "GRPC connection completed", map[string]interface{}{"client": c.ID(), "time": time.Since(started)}))
 	}(time.Now())
 
+	// When awaitingReplay, transport was constructed gated (closed) above, so
+	// any live push client.New's subscriptions triggered in the meantime is
+	// held rather than raced against what follows. Replay is queued via
+	// sendOrdered, which bypasses the gate; openGate then releases whatever
+	// piled up behind it, in arrival order - so a reconnecting client always
+	// sees what it missed before anything new. run is started first, so the
+	// replay is written to the stream as it is queued instead of filling
+	// sendCh with nothing draining it.
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- transport.run()
+	}()
+	if awaitingReplay {
+		err := s.replay.replay(replayClientID, replayLastSeq, transport.sendOrdered)
+		if err != nil {
+			// run is what actually drains closeCh and writes the disconnect
+			// trailer - waiting for it here ensures the Close below is
+			// picked up before returning.
+			c.Close(&proto.Disconnect{Reason: "error replaying missed messages", Reconnect: true})
+			<-runDone
+			return err
+		}
+	}
+	transport.openGate()
+
 	go func() {
 		for {
 			cmd, err := stream.Recv()
@@ -76,28 +389,284 @@ func (s *Service) Communicate(stream proto.Centrifugo_CommunicateServer) error {
 		}
 	}()
 
-	for reply := range replies {
-		if err := stream.Send(reply); err != nil {
-			return err
+	return <-runDone
+}
+
+// replyQueue holds grpcTransport's outbound reply queue, SendPolicy
+// bookkeeping and close/coalesce state, kept separate from the stream I/O
+// itself so that logic can be reasoned about and tested on its own.
+//
+// All lifecycle transitions (queued sends, Close, trailer setting) are
+// serialized through the single select loop in run, which is the only
+// goroutine allowed to touch the stream or decide the connection is done.
+// Send and Close only ever hand work to run over
+// channels, so they can be called concurrently from as many goroutines as
+// needed without racing on shared state (previously Close closed the reply
+// channel directly while Send wrote to it unlocked, which could panic with
+// "send on closed channel" and could drop the trailer disconnect).
+type replyQueue struct {
+	ctxDone <-chan struct{}
+	ctxErr  func() error
+
+	sendCh       chan *proto.Reply
+	closeCh      chan *proto.Disconnect
+	stopCh       chan struct{}
+	stopOnce     sync.Once
+	recordReplay func(*proto.Reply)
+
+	sendPolicy SendPolicy
+	// recordPolicyAction reports a drop/coalesce/block decision taken by
+	// Send under the configured SendPolicy, for operators tuning buffer
+	// size vs. drop behavior. Passed in by the constructor like every other
+	// field here; nil is a safe no-op.
+	recordPolicyAction func(action string)
+
+	coalesceMu sync.Mutex
+	coalesced  map[string]*proto.Reply // channel -> latest pending publication
+	wakeCh     chan struct{}
+
+	// gateMu/gated/pendingLive implement the replay-before-live-delivery
+	// barrier: while gated is true, ordinary Send calls are held in
+	// pendingLive instead of being enqueued, so replay (queued directly via
+	// sendOrdered, which never gates) is guaranteed to land in sendCh first.
+	// openGate flips gated false and replays pendingLive, in the order it
+	// arrived, right after. Connections with replay disabled construct the
+	// queue already open, so this is a no-op for them.
+	gateMu      sync.Mutex
+	gated       bool
+	pendingLive []*proto.Reply
+}
+
+func newReplyQueue(ctx context.Context, recordReplay func(*proto.Reply), recordPolicyAction func(action string), sendPolicy SendPolicy, gated bool) *replyQueue {
+	return &replyQueue{
+		ctxDone:            ctx.Done(),
+		ctxErr:             ctx.Err,
+		sendCh:             make(chan *proto.Reply, replyBufferSize),
+		closeCh:            make(chan *proto.Disconnect, 1),
+		stopCh:             make(chan struct{}),
+		recordReplay:       recordReplay,
+		sendPolicy:         sendPolicy,
+		recordPolicyAction: recordPolicyAction,
+		coalesced:          make(map[string]*proto.Reply),
+		wakeCh:             make(chan struct{}, 1),
+		gated:              gated,
+	}
+}
+
+// Send queues reply for delivery by run's outbound worker. It never touches
+// the stream itself, so it's safe to call concurrently with Close. What it
+// does when the queue is full is governed by sendPolicy: see SendPolicy.
+//
+// While the queue is gated (a reconnecting client asked for replay and it
+// hasn't finished yet), Send instead buffers reply in arrival order and
+// returns immediately - see openGate.
+func (q *replyQueue) Send(reply *proto.PreparedReply) error {
+	select {
+	case <-q.stopCh:
+		return fmt.Errorf("error sending to transport: transport closed")
+	default:
+	}
+
+	if q.bufferWhileGated(reply.Reply) {
+		return nil
+	}
+
+	return q.enqueue(reply.Reply)
+}
+
+// sendOrdered queues reply directly, bypassing the gate. It's used for the
+// replay itself, which must go out ahead of anything still buffered behind
+// the gate.
+func (q *replyQueue) sendOrdered(reply *proto.Reply) error {
+	return q.enqueue(reply)
+}
+
+// openGate stops gating Send and flushes whatever it buffered while gated,
+// in arrival order, directly behind whatever was already queued via
+// sendOrdered. Calling it on a queue that was never gated is a no-op.
+func (q *replyQueue) openGate() {
+	q.gateMu.Lock()
+	pending := q.pendingLive
+	q.pendingLive = nil
+	q.gated = false
+	q.gateMu.Unlock()
+
+	for _, reply := range pending {
+		q.enqueue(reply)
+	}
+}
+
+func (q *replyQueue) bufferWhileGated(reply *proto.Reply) bool {
+	q.gateMu.Lock()
+	defer q.gateMu.Unlock()
+	if !q.gated {
+		return false
+	}
+	q.pendingLive = append(q.pendingLive, reply)
+	return true
+}
+
+// enqueue applies the configured SendPolicy to reply, queuing it for run's
+// outbound worker and recording it for replay.
+func (q *replyQueue) enqueue(reply *proto.Reply) error {
+	switch q.sendPolicy {
+	case SendPolicyBlock:
+		select {
+		case q.sendCh <- reply:
+		default:
+			q.logPolicyAction("block")
+			select {
+			case q.sendCh <- reply:
+			case <-q.stopCh:
+				return fmt.Errorf("error sending to transport: transport closed")
+			case <-q.ctxDone:
+				return fmt.Errorf("error sending to transport: %v", q.ctxErr())
+			}
+		}
+	case SendPolicyDropOldest:
+		select {
+		case q.sendCh <- reply:
+		default:
+			select {
+			case <-q.sendCh:
+			default:
+			}
+			select {
+			case q.sendCh <- reply:
+			default:
+				q.logPolicyAction("drop_oldest")
+				return nil
+			}
+			q.logPolicyAction("drop_oldest")
+		}
+	case SendPolicyDropNewest:
+		select {
+		case q.sendCh <- reply:
+		default:
+			q.logPolicyAction("drop_newest")
+			return nil
+		}
+	case SendPolicyCoalesce:
+		if q.coalesce(reply) {
+			if q.recordReplay != nil {
+				q.recordReplay(reply)
+			}
+			return nil
+		}
+		select {
+		case q.sendCh <- reply:
+		default:
+			q.logPolicyAction("coalesce_overflow")
+			return nil
 		}
+	default:
+		select {
+		case q.sendCh <- reply:
+		default:
+			return fmt.Errorf("error sending to transport: buffer channel is full")
+		}
+	}
+
+	if q.recordReplay != nil {
+		q.recordReplay(reply)
+	}
+	return nil
+}
+
+// coalesce merges reply into the pending publication already queued for its
+// channel, if any, keeping only the latest. It only applies to channel
+// pushes (replayKeyFor reports ok) - direct command replies have nothing to
+// coalesce against and are queued as-is by the caller.
+func (q *replyQueue) coalesce(reply *proto.Reply) bool {
+	channel, _, ok := replayKeyFor(reply)
+	if !ok {
+		return false
+	}
+
+	q.coalesceMu.Lock()
+	_, hadPending := q.coalesced[channel]
+	q.coalesced[channel] = reply
+	q.coalesceMu.Unlock()
+
+	if hadPending {
+		q.logPolicyAction("coalesce_merged")
+	}
+
+	select {
+	case q.wakeCh <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (q *replyQueue) drainCoalesced() []*proto.Reply {
+	q.coalesceMu.Lock()
+	defer q.coalesceMu.Unlock()
+	if len(q.coalesced) == 0 {
+		return nil
+	}
+	replies := make([]*proto.Reply, 0, len(q.coalesced))
+	for channel, reply := range q.coalesced {
+		replies = append(replies, reply)
+		delete(q.coalesced, channel)
 	}
+	return replies
+}
 
+func (q *replyQueue) logPolicyAction(action string) {
+	if q.recordPolicyAction != nil {
+		q.recordPolicyAction(action)
+	}
+}
+
+// Close requests a shutdown of the transport. The actual trailer write
+// happens in run, once any replies already queued ahead of it have been
+// flushed to the stream. sendCh is never closed, so a concurrent Send can
+// never panic on it - at worst a reply queued right as Close runs is
+// dropped, never delivered.
+func (q *replyQueue) Close(disconnect *proto.Disconnect) error {
+	q.stopOnce.Do(func() {
+		close(q.stopCh)
+		q.closeCh <- disconnect
+	})
+	return nil
+}
+
+// flush drains any replies already queued to send: the plain queue first,
+// oldest first, then the pending coalesced replies, whose order across
+// channels is not defined. Used by run once a close request comes in, so nothing
+// queued ahead of the disconnect trailer is lost.
+func (q *replyQueue) flush(send func(*proto.Reply) error) error {
+	for {
+		select {
+		case reply := <-q.sendCh:
+			if err := send(reply); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+		break
+	}
+	for _, reply := range q.drainCoalesced() {
+		if err := send(reply); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // grpcTransport represents wrapper over stream to work with it
 // from outside in abstract way.
 type grpcTransport struct {
-	mu      sync.Mutex
-	closed  bool
-	stream  proto.Centrifugo_CommunicateServer
-	replies chan *proto.Reply
+	*replyQueue
+	stream proto.Centrifugo_CommunicateServer
 }
 
-func newGRPCTransport(stream proto.Centrifugo_CommunicateServer, replies chan *proto.Reply) *grpcTransport {
+func newGRPCTransport(stream proto.Centrifugo_CommunicateServer, recordReplay func(*proto.Reply), recordPolicyAction func(action string), sendPolicy SendPolicy, gated bool) *grpcTransport {
 	return &grpcTransport{
-		stream:  stream,
-		replies: replies,
+		replyQueue: newReplyQueue(stream.Context(), recordReplay, recordPolicyAction, sendPolicy, gated),
+		stream:     stream,
 	}
 }
 
@@ -109,27 +678,31 @@ func (t *grpcTransport) Encoding() proto.Encoding {
 	return proto.EncodingProtobuf
 }
 
-func (t *grpcTransport) Send(reply *proto.PreparedReply) error {
-	select {
-	case t.replies <- reply.Reply:
-	default:
-		return fmt.Errorf("error sending to transport: buffer channel is full")
-	}
-	return nil
-}
-
-func (t *grpcTransport) Close(disconnect *proto.Disconnect) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.closed {
-		return nil
-	}
-	t.closed = true
-	disconnectJSON, err := json.Marshal(disconnect)
-	if err != nil {
-		return err
+// run is the transport's single state-management goroutine: it owns the
+// stream, the outbound reply queue and every lifecycle transition. Reads
+// from sendCh, the stream write they trigger, close requests and trailer
+// setting are all serialized through this one select loop, and it doubles
+// as the dedicated outbound worker actually calling stream.Send.
+func (t *grpcTransport) run() error {
+	for {
+		select {
+		case reply := <-t.sendCh:
+			if err := t.stream.Send(reply); err != nil {
+				return err
+			}
+		case <-t.wakeCh:
+			for _, reply := range t.drainCoalesced() {
+				if err := t.stream.Send(reply); err != nil {
+					return err
+				}
+			}
+		case disconnect := <-t.closeCh:
+			if err := t.flush(t.stream.Send); err != nil {
+				return err
+			}
+			return setDisconnectTrailer(t.stream, disconnect)
+		case <-t.stream.Context().Done():
+			return t.stream.Context().Err()
+		}
 	}
-	t.stream.SetTrailer(metadata.Pairs("disconnect", string(disconnectJSON)))
-	close(t.replies)
-	return nil
 }
@@ -0,0 +1,369 @@
+package clientservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/centrifugal/centrifugo/lib/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeServerStream is a minimal grpc.ServerStream that lets
+// chainStreamInterceptors be driven directly, without standing up a real
+// GRPC server.
+type fakeServerStream struct{}
+
+func (s *fakeServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *fakeServerStream) SendHeader(metadata.MD) error { return nil }
+func (s *fakeServerStream) SetTrailer(metadata.MD)       {}
+func (s *fakeServerStream) Context() context.Context     { return context.Background() }
+func (s *fakeServerStream) SendMsg(m interface{}) error  { return nil }
+func (s *fakeServerStream) RecvMsg(m interface{}) error  { return nil }
+
+// TestChainStreamInterceptorsPreservesOrder checks that chained
+// interceptors run in the order they were configured, each wrapping the
+// next, with the handler itself running last.
+func TestChainStreamInterceptorsPreservesOrder(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.StreamServerInterceptor {
+		return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			calls = append(calls, name)
+			return handler(srv, ss)
+		}
+	}
+
+	chained := chainStreamInterceptors([]grpc.StreamServerInterceptor{
+		interceptor("first"), interceptor("second"), interceptor("third"),
+	})
+
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+
+	if err := chained(nil, &fakeServerStream{}, &grpc.StreamServerInfo{}, handler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"first", "second", "third", "handler"}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected call order %v, got %v", expected, calls)
+	}
+	for i, name := range expected {
+		if calls[i] != name {
+			t.Fatalf("expected call order %v, got %v", expected, calls)
+		}
+	}
+}
+
+// TestChainStreamInterceptorsEmpty checks that chaining no interceptors
+// just runs the handler directly.
+func TestChainStreamInterceptorsEmpty(t *testing.T) {
+	chained := chainStreamInterceptors(nil)
+
+	called := false
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		called = true
+		return nil
+	}
+
+	if err := chained(nil, &fakeServerStream{}, &grpc.StreamServerInfo{}, handler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Fatalf("expected handler to run when no interceptors are configured")
+	}
+}
+
+// TestCredentialsFromIncomingContextExtractsAuthAndUserID checks that both
+// the `authentication` and `user-id` metadata pairs are read into
+// client.Credentials.
+func TestCredentialsFromIncomingContextExtractsAuthAndUserID(t *testing.T) {
+	md := metadata.Pairs("authentication", "token-abc", "user-id", "user-1")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	creds := credentialsFromIncomingContext(ctx)
+	if creds == nil {
+		t.Fatalf("expected credentials to be extracted from metadata")
+	}
+	if creds.Token != "token-abc" || creds.UserID != "user-1" {
+		t.Fatalf("expected token %q and user-id %q, got %+v", "token-abc", "user-1", creds)
+	}
+}
+
+// TestCredentialsFromIncomingContextNilWhenAbsent checks that no
+// credentials are built when there's no incoming metadata at all, or
+// neither of the two headers it looks for is set - leaving identity
+// resolution to the client's Connect command instead.
+func TestCredentialsFromIncomingContextNilWhenAbsent(t *testing.T) {
+	if creds := credentialsFromIncomingContext(context.Background()); creds != nil {
+		t.Fatalf("expected nil credentials with no incoming metadata, got %+v", creds)
+	}
+
+	md := metadata.Pairs("some-other-header", "value")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	if creds := credentialsFromIncomingContext(ctx); creds != nil {
+		t.Fatalf("expected nil credentials when neither auth header is set, got %+v", creds)
+	}
+}
+
+// fakeCommunicateStream is a minimal proto.Centrifugo_CommunicateServer that
+// lets grpcTransport be driven directly, without standing up a real GRPC
+// server.
+type fakeCommunicateStream struct {
+	mu sync.Mutex
+}
+
+func (s *fakeCommunicateStream) Send(*proto.Reply) error {
+	return nil
+}
+
+func (s *fakeCommunicateStream) Recv() (*proto.Command, error) {
+	<-context.Background().Done()
+	return nil, nil
+}
+
+func (s *fakeCommunicateStream) SetHeader(metadata.MD) error  { return nil }
+func (s *fakeCommunicateStream) SendHeader(metadata.MD) error { return nil }
+
+func (s *fakeCommunicateStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+}
+
+func (s *fakeCommunicateStream) Context() context.Context    { return context.Background() }
+func (s *fakeCommunicateStream) SendMsg(m interface{}) error { return nil }
+func (s *fakeCommunicateStream) RecvMsg(m interface{}) error { return nil }
+
+// TestGRPCTransportConcurrentSendClose hammers Send and Close concurrently
+// to prove they no longer race on the shared reply channel - this used to
+// panic with "send on closed channel" under `go test -race` before run
+// became the single place that owns the channel's lifecycle.
+func TestGRPCTransportConcurrentSendClose(t *testing.T) {
+	transport := newGRPCTransport(&fakeCommunicateStream{}, nil, nil, SendPolicyBlock, false)
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- transport.run()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transport.Send(proto.NewPreparedReply(&proto.Reply{}, proto.EncodingProtobuf))
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		transport.Close(proto.DisconnectNormal)
+	}()
+
+	wg.Wait()
+	<-runDone
+}
+
+// TestGRPCTransportCloseIsIdempotent checks that calling Close multiple
+// times concurrently doesn't panic or deadlock.
+func TestGRPCTransportCloseIsIdempotent(t *testing.T) {
+	transport := newGRPCTransport(&fakeCommunicateStream{}, nil, nil, SendPolicyBlock, false)
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- transport.run()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transport.Close(proto.DisconnectNormal)
+		}()
+	}
+	wg.Wait()
+	<-runDone
+}
+
+// TestReplayStoreReplaysOnlyMissedEntries checks that replay only resends
+// pushes after lastSeq, in order, and forgets the client's buffer once
+// replayed.
+func TestReplayStoreReplaysOnlyMissedEntries(t *testing.T) {
+	store := newReplayStore(10, 0)
+
+	// Result holds opaque protobuf-encoded payload bytes here, not the JSON
+	// envelope replayKeyFor used to sniff out of it - channel/seq come from
+	// the Channel/Seq fields instead, so this is unaffected by Result's
+	// encoding.
+	push := func(seq uint64) *proto.Reply {
+		return &proto.Reply{Channel: "news", Seq: seq, Result: []byte{0x08, byte(seq)}}
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		store.store("client-1", push(seq))
+	}
+
+	var replayed []uint64
+	err := store.replay("client-1", 1, func(reply *proto.Reply) error {
+		_, seq, ok := replayKeyFor(reply)
+		if !ok {
+			t.Fatalf("expected replayed reply to carry a channel/seq")
+		}
+		replayed = append(replayed, seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(replayed) != 2 || replayed[0] != 2 || replayed[1] != 3 {
+		t.Fatalf("expected seqs [2 3], got %v", replayed)
+	}
+
+	replayed = nil
+	if err := store.replay("client-1", 0, func(reply *proto.Reply) error {
+		replayed = append(replayed, 0)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(replayed) != 0 {
+		t.Fatalf("expected buffer to be forgotten after first replay, got %v", replayed)
+	}
+}
+
+// TestReplayKeyForIgnoresResultEncoding checks that replayKeyFor derives
+// channel/seq from the Reply's own fields regardless of what Result holds -
+// it used to JSON-decode Result looking for a channel/seq envelope, which
+// always failed for protobuf-encoded traffic (grpcTransport declares
+// Encoding() proto.EncodingProtobuf) and left the replay buffer and
+// SendPolicyCoalesce silently inert against real connections.
+func TestReplayKeyForIgnoresResultEncoding(t *testing.T) {
+	for _, result := range [][]byte{
+		nil,
+		{0x08, 0x2a}, // arbitrary non-JSON bytes, standing in for a protobuf payload
+		[]byte(`{"channel":"news","seq":1}`),
+	} {
+		reply := &proto.Reply{Channel: "news", Seq: 7, Result: result}
+		channel, seq, ok := replayKeyFor(reply)
+		if !ok || channel != "news" || seq != 7 {
+			t.Fatalf("expected channel/seq from Reply fields regardless of Result %v, got %q %d %v", result, channel, seq, ok)
+		}
+	}
+
+	if _, _, ok := replayKeyFor(&proto.Reply{ID: 1, Channel: "news"}); ok {
+		t.Fatalf("expected a direct command reply (ID != 0) to never be replayable")
+	}
+	if _, _, ok := replayKeyFor(&proto.Reply{}); ok {
+		t.Fatalf("expected a reply with no channel to never be replayable")
+	}
+}
+
+// TestGRPCTransportGateOrdersReplayBeforeLiveSends checks that a live Send
+// arriving while the transport is still gated (i.e. replay for a
+// reconnecting client hasn't finished yet) is queued behind replay, even
+// though it was sent first - a live push racing the synchronous replay used
+// to land in sendCh ahead of the history it was supposed to follow.
+func TestGRPCTransportGateOrdersReplayBeforeLiveSends(t *testing.T) {
+	transport := newGRPCTransport(&fakeCommunicateStream{}, nil, nil, SendPolicyBlock, true)
+
+	live := &proto.Reply{Channel: "news", Seq: 99}
+	if err := transport.Send(proto.NewPreparedReply(live, proto.EncodingProtobuf)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	replayed := &proto.Reply{Channel: "news", Seq: 2}
+	if err := transport.sendOrdered(replayed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(transport.sendCh) != 1 {
+		t.Fatalf("expected only the replay queued while the gated live Send is still buffered, got %d queued", len(transport.sendCh))
+	}
+
+	transport.openGate()
+
+	first := <-transport.sendCh
+	second := <-transport.sendCh
+	if first != replayed || second != live {
+		t.Fatalf("expected replay to be delivered before the buffered live send, got %v then %v", first, second)
+	}
+}
+
+// TestGRPCTransportCoalesceRecordsReplay checks that a reply sent under
+// SendPolicyCoalesce is still handed to recordReplay - coalescing returns
+// early from Send and used to skip the recordReplay call entirely, which
+// silently disabled replay for any connection combining ReplayBufferSize
+// with SendPolicyCoalesce.
+func TestGRPCTransportCoalesceRecordsReplay(t *testing.T) {
+	var recorded []*proto.Reply
+	recordReplay := func(reply *proto.Reply) { recorded = append(recorded, reply) }
+
+	transport := newGRPCTransport(&fakeCommunicateStream{}, recordReplay, nil, SendPolicyCoalesce, false)
+
+	push := &proto.Reply{Channel: "news", Seq: 1, Result: []byte{0x08, 0x01}}
+	if err := transport.Send(proto.NewPreparedReply(push, proto.EncodingProtobuf)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(recorded) != 1 || recorded[0] != push {
+		t.Fatalf("expected coalesced reply to be recorded for replay, got %v", recorded)
+	}
+}
+
+// TestGRPCTransportCoalesceMergesProtobufEncodedPushes checks that
+// SendPolicyCoalesce actually merges two pushes on the same channel when
+// Result holds protobuf-encoded bytes rather than hand-constructed JSON -
+// coalesce gates on replayKeyFor same as the replay buffer does, so it used
+// to silently degrade to plain enqueue (never merging) for every real,
+// protobuf-encoded connection.
+func TestGRPCTransportCoalesceMergesProtobufEncodedPushes(t *testing.T) {
+	var dropped []string
+	recordPolicyAction := func(action string) { dropped = append(dropped, action) }
+
+	transport := newGRPCTransport(&fakeCommunicateStream{}, nil, recordPolicyAction, SendPolicyCoalesce, false)
+
+	first := &proto.Reply{Channel: "news", Seq: 1, Result: []byte{0x08, 0x01}}
+	second := &proto.Reply{Channel: "news", Seq: 2, Result: []byte{0x08, 0x02}}
+	if err := transport.Send(proto.NewPreparedReply(first, proto.EncodingProtobuf)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := transport.Send(proto.NewPreparedReply(second, proto.EncodingProtobuf)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pending := transport.drainCoalesced()
+	if len(pending) != 1 || pending[0] != second {
+		t.Fatalf("expected only the latest push on the channel to remain queued, got %v", pending)
+	}
+	if len(dropped) != 1 || dropped[0] != "coalesce_merged" {
+		t.Fatalf("expected a single coalesce_merged action, got %v", dropped)
+	}
+}
+
+// TestGRPCTransportDropNewestPolicy checks that once the queue is full,
+// SendPolicyDropNewest discards the new reply instead of erroring and
+// reports the drop via recordPolicyAction.
+func TestGRPCTransportDropNewestPolicy(t *testing.T) {
+	var dropped []string
+	recordPolicyAction := func(action string) { dropped = append(dropped, action) }
+	transport := newGRPCTransport(&fakeCommunicateStream{}, nil, recordPolicyAction, SendPolicyDropNewest, false)
+
+	for i := 0; i < replyBufferSize; i++ {
+		if err := transport.Send(proto.NewPreparedReply(&proto.Reply{}, proto.EncodingProtobuf)); err != nil {
+			t.Fatalf("unexpected error filling queue: %v", err)
+		}
+	}
+
+	if err := transport.Send(proto.NewPreparedReply(&proto.Reply{}, proto.EncodingProtobuf)); err != nil {
+		t.Fatalf("expected DropNewest to swallow the overflow, got error: %v", err)
+	}
+	if len(dropped) != 1 || dropped[0] != "drop_newest" {
+		t.Fatalf("expected a single drop_newest action, got %v", dropped)
+	}
+}